@@ -0,0 +1,246 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filesort
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/juju/errors"
+)
+
+// crcTable is the Castagnoli CRC32C polynomial table, as used by goleveldb
+// and other LSM engines for block/record checksums.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CompressionType denotes how a block's payload is encoded on disk.
+type CompressionType byte
+
+const (
+	// CompressionNone stores the block payload as-is.
+	CompressionNone CompressionType = iota
+	// CompressionSnappy compresses the block payload with snappy.
+	CompressionSnappy
+)
+
+const (
+	// blockHeaderSize is the size in bytes of the fixed block header:
+	// [uint32 uncompressedLen][uint32 compressedLen][byte compressionType].
+	blockHeaderSize = 4 + 4 + 1
+
+	// blockTrailerSize is the size in bytes of the CRC32C checksum that
+	// follows every block, computed over the header and payload.
+	blockTrailerSize = 4
+
+	// defaultBlockSize is the target amount of uncompressed row bytes
+	// gathered into a single block before it is flushed to disk.
+	defaultBlockSize = 64 * 1024
+)
+
+// blockWriter buffers encoded rows and periodically flushes them as a single
+// framed, optionally compressed block, modeled on the block layout used by
+// LSM engines such as goleveldb.
+type blockWriter struct {
+	w         *bufio.Writer
+	kind      CompressionType
+	blockSize int
+	buf       []byte
+	header    []byte
+	trailer   []byte
+	dst       []byte
+}
+
+// newBlockWriter creates a blockWriter which frames blocks of roughly
+// blockSize uncompressed bytes and writes them to w using kind compression.
+func newBlockWriter(w io.Writer, kind CompressionType, blockSize int) *blockWriter {
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+	return &blockWriter{
+		w:         bufio.NewWriter(w),
+		kind:      kind,
+		blockSize: blockSize,
+		header:    make([]byte, blockHeaderSize),
+		trailer:   make([]byte, blockTrailerSize),
+	}
+}
+
+// appendRow adds one already-encoded row (including its own 8-byte length
+// prefix) to the current block, then flushes the block once it holds at
+// least blockSize bytes.
+func (bw *blockWriter) appendRow(row []byte) error {
+	bw.buf = append(bw.buf, row...)
+	if len(bw.buf) >= bw.blockSize {
+		return bw.flush()
+	}
+	return nil
+}
+
+// flush frames the accumulated rows as a single block and writes it out.
+func (bw *blockWriter) flush() error {
+	if len(bw.buf) == 0 {
+		return nil
+	}
+
+	payload := bw.buf
+	if bw.kind == CompressionSnappy {
+		bw.dst = snappy.Encode(bw.dst[:cap(bw.dst)], payload)
+		payload = bw.dst
+	}
+
+	binary.BigEndian.PutUint32(bw.header[0:4], uint32(len(bw.buf)))
+	binary.BigEndian.PutUint32(bw.header[4:8], uint32(len(payload)))
+	bw.header[8] = byte(bw.kind)
+
+	crc := crc32.New(crcTable)
+	crc.Write(bw.header)
+	crc.Write(payload)
+	binary.BigEndian.PutUint32(bw.trailer, crc.Sum32())
+
+	if _, err := bw.w.Write(bw.header); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := bw.w.Write(payload); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := bw.w.Write(bw.trailer); err != nil {
+		return errors.Trace(err)
+	}
+
+	bw.buf = bw.buf[:0]
+	return nil
+}
+
+// Close flushes any buffered rows and the underlying bufio.Writer.
+func (bw *blockWriter) Close() error {
+	if err := bw.flush(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(bw.w.Flush())
+}
+
+// blockReader reads back the blocks written by blockWriter and lets the
+// caller iterate the rows they contain one at a time.
+type blockReader struct {
+	r       *bufio.Reader
+	path    string
+	offset  int64
+	header  []byte
+	trailer []byte
+	src     []byte
+	buf     []byte
+	pos     int
+}
+
+// newBlockReader creates a blockReader over r. path is only used to
+// annotate ErrSpillCorrupted and may be empty.
+func newBlockReader(r io.Reader, path string) *blockReader {
+	return &blockReader{
+		r:       bufio.NewReader(r),
+		path:    path,
+		header:  make([]byte, blockHeaderSize),
+		trailer: make([]byte, blockTrailerSize),
+	}
+}
+
+func (br *blockReader) corrupted(reason string) error {
+	return errors.Trace(&ErrSpillCorrupted{Path: br.path, Offset: br.offset, Reason: reason})
+}
+
+// nextBlock reads and decodes the next block into br.buf. It returns io.EOF
+// once there are no more blocks.
+func (br *blockReader) nextBlock() error {
+	start := br.offset
+	n, err := io.ReadFull(br.r, br.header)
+	if err == io.EOF {
+		return io.EOF
+	}
+	br.offset += int64(n)
+	if err != nil {
+		return br.corrupted("short read")
+	}
+
+	uncompressedLen := binary.BigEndian.Uint32(br.header[0:4])
+	compressedLen := binary.BigEndian.Uint32(br.header[4:8])
+	kind := CompressionType(br.header[8])
+
+	if cap(br.src) < int(compressedLen) {
+		br.src = make([]byte, compressedLen)
+	}
+	src := br.src[:compressedLen]
+	n, err = io.ReadFull(br.r, src)
+	br.offset += int64(n)
+	if err != nil {
+		return br.corrupted("short read")
+	}
+
+	n, err = io.ReadFull(br.r, br.trailer)
+	br.offset += int64(n)
+	if err != nil {
+		return br.corrupted("short read")
+	}
+
+	crc := crc32.New(crcTable)
+	crc.Write(br.header)
+	crc.Write(src)
+	if crc.Sum32() != binary.BigEndian.Uint32(br.trailer) {
+		br.offset = start
+		return br.corrupted("crc mismatch")
+	}
+
+	switch kind {
+	case CompressionSnappy:
+		if cap(br.buf) < int(uncompressedLen) {
+			br.buf = make([]byte, uncompressedLen)
+		}
+		dst, err := snappy.Decode(br.buf[:uncompressedLen], src)
+		if err != nil {
+			br.offset = start
+			return br.corrupted("decode error")
+		}
+		br.buf = dst
+	default:
+		br.buf = src
+	}
+
+	br.pos = 0
+	return nil
+}
+
+// nextRow returns the bytes of the next encoded row, reading a new block
+// from disk when the current one has been exhausted.
+func (br *blockReader) nextRow() ([]byte, error) {
+	if br.pos >= len(br.buf) {
+		if err := br.nextBlock(); err != nil {
+			return nil, err
+		}
+	}
+
+	if br.pos+8 > len(br.buf) {
+		return nil, br.corrupted("bad header")
+	}
+	rowSize := int(binary.BigEndian.Uint64(br.buf[br.pos : br.pos+8]))
+	br.pos += 8
+
+	if rowSize < 0 || br.pos+rowSize > len(br.buf) {
+		return nil, br.corrupted("decode error")
+	}
+	row := br.buf[br.pos : br.pos+rowSize]
+	br.pos += rowSize
+
+	return row, nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filesort
+
+import "fmt"
+
+// ErrSpillCorrupted is returned when a spill file fails to parse or fails
+// its checksum. It carries enough context to tell disk corruption apart
+// from a transient I/O error, and to locate the bad block on disk.
+type ErrSpillCorrupted struct {
+	Path   string
+	Offset int64
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ErrSpillCorrupted) Error() string {
+	return fmt.Sprintf("filesort: spill file %q corrupted at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
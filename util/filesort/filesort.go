@@ -15,14 +15,12 @@ package filesort
 
 import (
 	"container/heap"
+	"context"
 	"encoding/binary"
 	"io"
-	"os"
-	"path"
 	"sort"
 	"strconv"
 	"sync"
-	"time"
 
 	"github.com/juju/errors"
 	"github.com/pingcap/tidb/sessionctx/variable"
@@ -112,29 +110,34 @@ type FileSorter struct {
 	workers  []*Worker
 	cWorker  int
 	nWorkers int
-
-	mu      sync.Mutex
-	wg      sync.WaitGroup
-	tmpDir  string
-	files   []string
-	nFiles  int
-	closed  bool
-	fetched bool
-
-	rowHeap    *rowHeap
-	fds        []*os.File
-	rowBytes   []byte
-	head       []byte
-	dcod       []types.Datum
-	keySize    int
-	valSize    int
-	maxRowSize int
+	ready    chan int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	wg         sync.WaitGroup
+	storage    Storage
+	files      []string
+	nFiles     int
+	mergeFanIn int
+	closed     bool
+	fetched    bool
+
+	rowHeap     *rowHeap
+	rcs         []ReadSeekCloser
+	brs         []*blockReader
+	dcod        []types.Datum
+	keySize     int
+	valSize     int
+	maxRowSize  int
+	compression CompressionType
 }
 
 func (fs *FileSorter) getUniqueFileName() string {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
-	ret := path.Join(fs.tmpDir, strconv.Itoa(fs.nFiles))
+	ret := strconv.Itoa(fs.nFiles)
 	fs.nFiles++
 	return ret
 }
@@ -146,27 +149,31 @@ func (fs *FileSorter) appendFileName(fn string) {
 }
 
 func (fs *FileSorter) closeAllFiles() error {
-	for _, fd := range fs.fds {
-		err := fd.Close()
+	for _, rc := range fs.rcs {
+		err := rc.Close()
 		if err != nil {
 			return errors.Trace(err)
 		}
 	}
-	err := os.RemoveAll(fs.tmpDir)
-	if err != nil {
-		return errors.Trace(err)
+	fs.rcs = nil
+	fs.brs = nil
+	for _, fname := range fs.files {
+		if err := fs.storage.Remove(fname); err != nil {
+			return errors.Trace(err)
+		}
 	}
+	fs.files = nil
 	return nil
 }
 
 // Perform external file sort.
 func (fs *FileSorter) externalSort() (*comparableRow, error) {
 	if !fs.fetched {
+		// Closing each worker's input channel tells its goroutine there is
+		// no more input coming; the goroutine flushes whatever it still
+		// has buffered and exits.
 		for _, w := range fs.workers {
-			if !w.busy && len(w.buf) > 0 {
-				fs.wg.Add(1)
-				go w.flushToFile()
-			}
+			close(w.in)
 		}
 
 		fs.wg.Wait()
@@ -180,19 +187,21 @@ func (fs *FileSorter) externalSort() (*comparableRow, error) {
 			}
 		}
 
+		if err := fs.mergeDown(); err != nil {
+			return nil, errors.Trace(err)
+		}
+
 		heap.Init(fs.rowHeap)
 		if fs.rowHeap.err != nil {
 			return nil, errors.Trace(fs.rowHeap.err)
 		}
 
-		fs.rowBytes = make([]byte, fs.maxRowSize)
-
 		err := fs.openAllFiles()
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
 
-		for id := range fs.fds {
+		for id := range fs.rcs {
 			row, err := fs.fetchNextRow(id)
 			if err != nil {
 				return nil, errors.Trace(err)
@@ -245,44 +254,35 @@ func (fs *FileSorter) externalSort() (*comparableRow, error) {
 
 func (fs *FileSorter) openAllFiles() error {
 	for _, fname := range fs.files {
-		fd, err := os.Open(fname)
+		rc, err := fs.storage.Open(fname)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		fs.fds = append(fs.fds, fd)
+		fs.rcs = append(fs.rcs, rc)
+		fs.brs = append(fs.brs, newBlockReader(rc, fname))
 	}
 	return nil
 }
 
-// Fetch the next row given the source file index.
+// Fetch the next row given the source file index. Rows are read block by
+// block; once the current block is exhausted the next one is pulled off
+// disk and decompressed transparently.
 func (fs *FileSorter) fetchNextRow(index int) (*comparableRow, error) {
-	var (
-		err error
-		n   int
-	)
-	n, err = fs.fds[index].Read(fs.head)
+	rowBytes, err := fs.brs[index].nextRow()
 	if err == io.EOF {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	if n != 8 {
-		return nil, errors.New("incorrect header")
-	}
-	rowSize := int(binary.BigEndian.Uint64(fs.head))
-
-	n, err = fs.fds[index].Read(fs.rowBytes)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	if n != rowSize {
-		return nil, errors.New("incorrect row")
-	}
 
-	fs.dcod, err = codec.Decode(fs.rowBytes, fs.keySize+fs.valSize+1)
+	fs.dcod, err = codec.Decode(rowBytes, fs.keySize+fs.valSize+1)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, errors.Trace(&ErrSpillCorrupted{
+			Path:   fs.files[index],
+			Offset: fs.brs[index].offset,
+			Reason: "decode error",
+		})
 	}
 
 	return &comparableRow{
@@ -302,32 +302,48 @@ func (fs *FileSorter) Input(key []types.Datum, val []types.Datum, handle int64)
 		return errors.New("call input after output")
 	}
 
-	assigned := false
 	row := &comparableRow{
 		key:    key,
 		val:    val,
 		handle: handle,
 	}
 
-	for {
-		for i := 0; i < fs.nWorkers; i++ {
-			wid := (fs.cWorker + i) % fs.nWorkers
-			if !fs.workers[wid].busy {
-				err := fs.workers[wid].input(row)
-				if err != nil {
-					return errors.Trace(err)
-				}
-				assigned = true
-				fs.cWorker = wid
-				break
-			}
+	// Fast path: a worker that just drained its buffer announced itself on
+	// the ready channel; try it first.
+	select {
+	case wid := <-fs.ready:
+		select {
+		case fs.workers[wid].in <- row:
+			fs.cWorker = wid
+			return nil
+		default:
+		}
+	default:
+	}
+
+	// Round-robin over workers, taking whichever has room without blocking.
+	for i := 0; i < fs.nWorkers; i++ {
+		wid := (fs.cWorker + i) % fs.nWorkers
+		select {
+		case fs.workers[wid].in <- row:
+			fs.cWorker = wid
+			return nil
+		default:
 		}
-		if assigned {
-			break
-		} else {
-			time.Sleep(100 * time.Millisecond)
+	}
+
+	// Every worker's channel is full; fall back to the least-loaded one and
+	// block until it has room.
+	wid := 0
+	minLen := len(fs.workers[0].in)
+	for i := 1; i < fs.nWorkers; i++ {
+		if l := len(fs.workers[i].in); l < minLen {
+			minLen = l
+			wid = i
 		}
 	}
+	fs.workers[wid].in <- row
+	fs.cWorker = wid
 	return nil
 }
 
@@ -351,6 +367,11 @@ func (fs *FileSorter) Close() error {
 	if fs.closed {
 		return errors.New("FileSorter has been closed")
 	}
+	// Tell any worker goroutine still waiting on its input channel to stop
+	// immediately rather than flushing the rows it has buffered. A flush
+	// that is already running is not interrupted: wg.Wait returns only
+	// after it has finished writing its spill file.
+	fs.cancel()
 	fs.wg.Wait()
 	err := fs.closeAllFiles()
 	if err != nil {
@@ -365,15 +386,17 @@ func (fs *FileSorter) Close() error {
 
 // Worker actually sorts the file.
 type Worker struct {
-	ctx     *FileSorter
-	busy    bool
-	keySize int
-	valSize int
-	rowSize int
-	bufSize int
-	buf     []*comparableRow
-	head    []byte
-	err     error
+	ctx         *FileSorter
+	index       int
+	in          chan *comparableRow
+	keySize     int
+	valSize     int
+	rowSize     int
+	bufSize     int
+	buf         []*comparableRow
+	head        []byte
+	compression CompressionType
+	err         error
 }
 
 func (w *Worker) Len() int { return len(w.buf) }
@@ -388,29 +411,52 @@ func (w *Worker) Less(i, j int) bool {
 	return ret
 }
 
-func (w *Worker) input(row *comparableRow) error {
-	w.buf = append(w.buf, row)
+// run reads rows off w.in until it is closed or ctx is cancelled, flushing
+// w.buf to a spill file whenever it fills up. It is the only goroutine that
+// ever touches w.buf, so no locking is required around it. Once flushToFile
+// records an error, the worker is quarantined: it keeps draining w.in so
+// Input never blocks on it, but drops rows instead of growing w.buf without
+// bound for the rest of the input phase.
+func (w *Worker) run(ctx context.Context) {
+	defer w.ctx.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case row, ok := <-w.in:
+			if !ok {
+				if len(w.buf) > 0 && w.err == nil {
+					w.flushToFile()
+				}
+				return
+			}
 
-	if len(w.buf) >= w.bufSize {
-		w.busy = true
-		w.ctx.wg.Add(1)
-		go w.flushToFile()
-	}
+			if w.err != nil {
+				continue
+			}
 
-	if w.err != nil {
-		return errors.Trace(w.err)
+			w.buf = append(w.buf, row)
+			if len(w.buf) >= w.bufSize {
+				w.flushToFile()
+				select {
+				case w.ctx.ready <- w.index:
+				default:
+				}
+			}
+		}
 	}
-	return nil
 }
 
-// Flush the buffer to file if it is full.
+// Flush the buffer to a new spill file. run calls it whenever the buffer
+// fills up, and once more for any leftover rows when input ends. Rows are
+// encoded and grouped into
+// compressed, checksummed blocks by a blockWriter rather than written
+// individually.
 func (w *Worker) flushToFile() {
-	defer w.ctx.wg.Done()
 	var (
 		err        error
-		outputFile *os.File
-		outputByte []byte
-		prevLen    int
+		outputFile WriteCloser
+		rowBytes   []byte
 	)
 
 	sort.Sort(w)
@@ -420,59 +466,63 @@ func (w *Worker) flushToFile() {
 
 	fileName := w.ctx.getUniqueFileName()
 
-	outputFile, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	outputFile, err = w.ctx.storage.Create(fileName)
 	if err != nil {
 		w.err = err
 		return
 	}
 	defer outputFile.Close()
 
+	bw := newBlockWriter(outputFile, w.compression, defaultBlockSize)
+
 	for _, row := range w.buf {
-		prevLen = len(outputByte)
-		outputByte = append(outputByte, w.head...)
-		outputByte, err = codec.EncodeKey(outputByte, row.key...)
+		rowBytes = rowBytes[:0]
+		rowBytes = append(rowBytes, w.head...)
+		rowBytes, err = codec.EncodeKey(rowBytes, row.key...)
 		if err != nil {
 			w.err = err
 			return
 		}
-		outputByte, err = codec.EncodeKey(outputByte, row.val...)
+		rowBytes, err = codec.EncodeKey(rowBytes, row.val...)
 		if err != nil {
 			w.err = err
 			return
 		}
-		outputByte, err = codec.EncodeKey(outputByte, types.NewIntDatum(row.handle))
+		rowBytes, err = codec.EncodeKey(rowBytes, types.NewIntDatum(row.handle))
 		if err != nil {
 			w.err = err
 			return
 		}
 
-		if len(outputByte)-prevLen-8 > w.rowSize {
-			w.rowSize = len(outputByte) - prevLen - 8
+		if len(rowBytes)-8 > w.rowSize {
+			w.rowSize = len(rowBytes) - 8
 		}
-		binary.BigEndian.PutUint64(w.head, uint64(len(outputByte)-prevLen-8))
-		for i := 0; i < 8; i++ {
-			outputByte[prevLen+i] = w.head[i]
+		binary.BigEndian.PutUint64(w.head, uint64(len(rowBytes)-8))
+		copy(rowBytes[:8], w.head)
+
+		if err = bw.appendRow(rowBytes); err != nil {
+			w.err = err
+			return
 		}
 	}
 
-	_, err = outputFile.Write(outputByte)
-	if err != nil {
+	if err = bw.Close(); err != nil {
 		w.err = err
 		return
 	}
 
 	w.ctx.appendFileName(fileName)
 	w.buf = w.buf[:0]
-	w.busy = false
-	return
 }
 
 // Builder builds a new FileSorter.
 type Builder struct {
-	keySize int
-	valSize int
-	bufSize int
-	tmpDir  string
+	keySize     int
+	valSize     int
+	bufSize     int
+	storage     Storage
+	compression CompressionType
+	mergeFanIn  int
 }
 
 // SetSC sets StatementContext instance which is required in row comparison.
@@ -500,9 +550,35 @@ func (b *Builder) SetDesc(byDesc []bool) *Builder {
 	return b
 }
 
-// SetDir sets the working directory for FileSorter.
+// SetDir sets the working directory for FileSorter. It is a convenience
+// wrapper around SetStorage(NewFileStorage(tmpDir)).
 func (b *Builder) SetDir(tmpDir string) *Builder {
-	b.tmpDir = tmpDir
+	b.storage = NewFileStorage(tmpDir)
+	return b
+}
+
+// SetStorage sets the Storage backend FileSorter uses for its spill files.
+// Use this instead of SetDir to plug in e.g. a MemStorage for tests or an
+// encrypted backend for production.
+func (b *Builder) SetStorage(storage Storage) *Builder {
+	b.storage = storage
+	return b
+}
+
+// SetCompression sets the compression used for spill files. It defaults to
+// CompressionNone when not called.
+func (b *Builder) SetCompression(kind CompressionType) *Builder {
+	b.compression = kind
+	return b
+}
+
+// SetMergeFanIn sets how many spill files externalSort merges at a time.
+// Once more than k files remain after the worker flush phase, they are
+// cascaded down k at a time until at most k are left for the final
+// streaming merge. It defaults to 16 when not called or set to <= 0; k == 1
+// is rejected by Build since it can never shrink the file count.
+func (b *Builder) SetMergeFanIn(k int) *Builder {
+	b.mergeFanIn = k
 	return b
 }
 
@@ -524,23 +600,29 @@ func (b *Builder) Build() (*FileSorter, error) {
 	if b.bufSize <= 0 {
 		return nil, errors.New("buffer size is not positive")
 	}
-	_, err := os.Stat(b.tmpDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, errors.New("tmpDir does not exist")
-		}
-		return nil, errors.Trace(err)
+	if b.storage == nil {
+		return nil, errors.New("storage is nil")
+	}
+	if b.mergeFanIn <= 0 {
+		b.mergeFanIn = defaultMergeFanIn
+	}
+	if b.mergeFanIn == 1 {
+		return nil, errors.New("merge fan-in must be at least 2")
 	}
 
+	workerBufSize := b.bufSize / nWorkers
 	ws := make([]*Worker, nWorkers)
 	for i := range ws {
 		ws[i] = &Worker{
-			keySize: b.keySize,
-			valSize: b.valSize,
-			rowSize: b.keySize + b.valSize + 1,
-			bufSize: b.bufSize / nWorkers,
-			buf:     make([]*comparableRow, 0, b.bufSize/nWorkers),
-			head:    make([]byte, 8),
+			index:       i,
+			in:          make(chan *comparableRow, workerBufSize),
+			keySize:     b.keySize,
+			valSize:     b.valSize,
+			rowSize:     b.keySize + b.valSize + 1,
+			bufSize:     workerBufSize,
+			buf:         make([]*comparableRow, 0, workerBufSize),
+			head:        make([]byte, 8),
+			compression: b.compression,
 		}
 	}
 
@@ -548,23 +630,32 @@ func (b *Builder) Build() (*FileSorter, error) {
 		ims: make([]*item, 0),
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	fs := &FileSorter{
 		workers:  ws,
 		cWorker:  0,
 		nWorkers: nWorkers,
+		ready:    make(chan int, nWorkers),
+
+		ctx:    ctx,
+		cancel: cancel,
 
-		head:    make([]byte, 8),
 		dcod:    make([]types.Datum, 0, b.keySize+b.valSize+1),
 		keySize: b.keySize,
 		valSize: b.valSize,
 
-		tmpDir:  b.tmpDir,
-		files:   make([]string, 0),
-		rowHeap: rh,
+		storage:     b.storage,
+		files:       make([]string, 0),
+		mergeFanIn:  b.mergeFanIn,
+		rowHeap:     rh,
+		compression: b.compression,
 	}
 
+	fs.wg.Add(nWorkers)
 	for i := 0; i < nWorkers; i++ {
 		fs.workers[i].ctx = fs
+		go fs.workers[i].run(ctx)
 	}
 
 	return fs, nil
@@ -0,0 +1,158 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filesort
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/sessionctx/variable"
+	"github.com/pingcap/tidb/util/types"
+)
+
+func testBlockRoundTrip(t *testing.T, kind CompressionType) {
+	payloads := [][]byte{
+		[]byte("a"),
+		[]byte("bb"),
+		bytes.Repeat([]byte("x"), 100),
+		[]byte("cc"),
+		[]byte("ddd"),
+	}
+
+	var buf bytes.Buffer
+	bw := newBlockWriter(&buf, kind, 16)
+	for _, p := range payloads {
+		if err := bw.appendRow(frameRow(p)); err != nil {
+			t.Fatalf("appendRow: %v", err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	br := newBlockReader(bytes.NewReader(buf.Bytes()), "test")
+	for i, want := range payloads {
+		row, err := br.nextRow()
+		if err != nil {
+			t.Fatalf("nextRow %d: %v", i, err)
+		}
+		if !bytes.Equal(row, want) {
+			t.Fatalf("nextRow %d = %q, want %q", i, row, want)
+		}
+	}
+
+	if _, err := br.nextRow(); err != io.EOF {
+		t.Fatalf("nextRow after last row = %v, want io.EOF", err)
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	testBlockRoundTrip(t, CompressionNone)
+	testBlockRoundTrip(t, CompressionSnappy)
+}
+
+func TestBlockCRCMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	bw := newBlockWriter(&buf, CompressionNone, defaultBlockSize)
+	if err := bw.appendRow(frameRow([]byte("hello"))); err != nil {
+		t.Fatalf("appendRow: %v", err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	corrupted := buf.Bytes()
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	br := newBlockReader(bytes.NewReader(corrupted), "test")
+	_, err := br.nextRow()
+	if err == nil {
+		t.Fatal("nextRow on corrupted block returned no error")
+	}
+
+	spillErr, ok := errors.Cause(err).(*ErrSpillCorrupted)
+	if !ok {
+		t.Fatalf("errors.Cause(err) = %T, want *ErrSpillCorrupted", errors.Cause(err))
+	}
+	if spillErr.Reason != "crc mismatch" {
+		t.Fatalf("Reason = %q, want %q", spillErr.Reason, "crc mismatch")
+	}
+}
+
+func TestFileSorterMergeCascade(t *testing.T) {
+	const (
+		keySize = 1
+		valSize = 1
+		numRows = 200
+		bufSize = 30
+		fanIn   = 2
+	)
+
+	builder := new(Builder)
+	fs, err := builder.
+		SetSC(&variable.StatementContext{TimeZone: nil}).
+		SetSchema(keySize, valSize).
+		SetBuf(bufSize).
+		SetDesc([]bool{false}).
+		SetStorage(NewMemStorage()).
+		SetMergeFanIn(fanIn).
+		Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	defer fs.Close()
+
+	perm := rand.New(rand.NewSource(1)).Perm(numRows)
+	for _, v := range perm {
+		key := []types.Datum{types.NewIntDatum(int64(v))}
+		val := []types.Datum{types.NewIntDatum(int64(v * 2))}
+		if err := fs.Input(key, val, int64(v)); err != nil {
+			t.Fatalf("Input(%d): %v", v, err)
+		}
+	}
+
+	if len(fs.files) <= fanIn {
+		t.Fatalf("got %d spill files, want more than mergeFanIn (%d) to exercise mergeDown's cascade", len(fs.files), fanIn)
+	}
+
+	for want := 0; want < numRows; want++ {
+		key, val, handle, err := fs.Output()
+		if err != nil {
+			t.Fatalf("Output() at row %d: %v", want, err)
+		}
+		if key == nil {
+			t.Fatalf("Output() at row %d returned no row, want %d more rows", want, numRows-want)
+		}
+		if got := key[0].GetInt64(); got != int64(want) {
+			t.Fatalf("row %d: key = %d, want %d", want, got, want)
+		}
+		if got := val[0].GetInt64(); got != int64(want)*2 {
+			t.Fatalf("row %d: val = %d, want %d", want, got, want*2)
+		}
+		if handle != int64(want) {
+			t.Fatalf("row %d: handle = %d, want %d", want, handle, want)
+		}
+	}
+
+	key, _, _, err := fs.Output()
+	if err != nil {
+		t.Fatalf("final Output(): %v", err)
+	}
+	if key != nil {
+		t.Fatalf("final Output() = %v, want no more rows", key)
+	}
+}
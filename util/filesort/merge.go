@@ -0,0 +1,214 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filesort
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"io"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tidb/util/types"
+)
+
+// defaultMergeFanIn bounds how many spill files externalSort merges
+// simultaneously, keeping the number of open file descriptors and the
+// width of the merge heap in check.
+const defaultMergeFanIn = 16
+
+// mergeHeapItem is one spill file's current row in a cascading merge pass.
+type mergeHeapItem struct {
+	index int // source file index within the current merge batch
+	key   []types.Datum
+	raw   []byte // the row's encoded bytes, header NOT included (blockReader strips it)
+}
+
+// mergeHeap is a min-heap of mergeHeapItems, ordered the same way as
+// rowHeap.
+type mergeHeap struct {
+	items []*mergeHeapItem
+	err   error
+}
+
+// Len implements heap.Interface Len interface.
+func (mh *mergeHeap) Len() int { return len(mh.items) }
+
+// Swap implements heap.Interface Swap interface.
+func (mh *mergeHeap) Swap(i, j int) { mh.items[i], mh.items[j] = mh.items[j], mh.items[i] }
+
+// Less implements heap.Interface Less interface.
+func (mh *mergeHeap) Less(i, j int) bool {
+	ret, err := lessThan(gSc, mh.items[i].key, mh.items[j].key, gByDesc)
+	if mh.err == nil {
+		mh.err = err
+	}
+	return ret
+}
+
+// Push implements heap.Interface Push interface.
+func (mh *mergeHeap) Push(x interface{}) {
+	mh.items = append(mh.items, x.(*mergeHeapItem))
+}
+
+// Pop implements heap.Interface Pop interface.
+func (mh *mergeHeap) Pop() interface{} {
+	old := mh.items
+	n := len(old)
+	x := old[n-1]
+	mh.items = old[0 : n-1]
+	return x
+}
+
+// frameRow re-attaches the 8-byte big-endian length prefix that
+// blockReader.nextRow strips off, so a row read back out of one spill file
+// can be written into another via blockWriter.appendRow, which expects it.
+func frameRow(raw []byte) []byte {
+	framed := make([]byte, 8+len(raw))
+	binary.BigEndian.PutUint64(framed[:8], uint64(len(raw)))
+	copy(framed[8:], raw)
+	return framed
+}
+
+// fetchNextMergeRow reads the next row off br, decoding just enough to
+// obtain its sort key. It returns a nil raw slice once br is exhausted.
+func (fs *FileSorter) fetchNextMergeRow(br *blockReader) (raw []byte, key []types.Datum, err error) {
+	raw, err = br.nextRow()
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	dcod, err := codec.Decode(raw, fs.keySize+fs.valSize+1)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return raw, dcod[:fs.keySize], nil
+}
+
+// mergeFiles k-way merges the given spill files into a single new spill
+// file, written through the same block-framed, compressed, checksummed
+// format worker flushes use, then removes the originals. It returns the
+// name of the newly created file.
+//
+// On any error it cleans up after itself: every reader opened for this
+// batch is closed, and the new output file (if one was created) is
+// removed from storage rather than left orphaned.
+func (fs *FileSorter) mergeFiles(names []string) (string, error) {
+	rcs := make([]ReadSeekCloser, 0, len(names))
+	defer func() {
+		for _, rc := range rcs {
+			rc.Close()
+		}
+	}()
+
+	var fileName string
+	succeeded := false
+	defer func() {
+		if !succeeded && fileName != "" {
+			fs.storage.Remove(fileName)
+		}
+	}()
+
+	brs := make([]*blockReader, 0, len(names))
+
+	for _, name := range names {
+		rc, err := fs.storage.Open(name)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		rcs = append(rcs, rc)
+		brs = append(brs, newBlockReader(rc, name))
+	}
+
+	mh := &mergeHeap{}
+	for i, br := range brs {
+		raw, key, err := fs.fetchNextMergeRow(br)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if raw == nil {
+			return "", errors.New("file is empty")
+		}
+		heap.Push(mh, &mergeHeapItem{index: i, key: key, raw: raw})
+		if mh.err != nil {
+			return "", errors.Trace(mh.err)
+		}
+	}
+
+	fileName = fs.getUniqueFileName()
+	outputFile, err := fs.storage.Create(fileName)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer outputFile.Close()
+
+	bw := newBlockWriter(outputFile, fs.compression, defaultBlockSize)
+
+	for mh.Len() > 0 {
+		it := heap.Pop(mh).(*mergeHeapItem)
+		if mh.err != nil {
+			return "", errors.Trace(mh.err)
+		}
+
+		if err := bw.appendRow(frameRow(it.raw)); err != nil {
+			return "", errors.Trace(err)
+		}
+
+		raw, key, err := fs.fetchNextMergeRow(brs[it.index])
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		if raw != nil {
+			heap.Push(mh, &mergeHeapItem{index: it.index, key: key, raw: raw})
+			if mh.err != nil {
+				return "", errors.Trace(mh.err)
+			}
+		}
+	}
+
+	if err := bw.Close(); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	for _, name := range names {
+		if err := fs.storage.Remove(name); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+
+	succeeded = true
+	return fileName, nil
+}
+
+// mergeDown repeatedly merges the first mergeFanIn spill files into one
+// until at most mergeFanIn files remain, bounding the number of files the
+// final streaming merge has to keep open at once.
+func (fs *FileSorter) mergeDown() error {
+	for len(fs.files) > fs.mergeFanIn {
+		batch := fs.files[:fs.mergeFanIn]
+		newName, err := fs.mergeFiles(batch)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		remaining := make([]string, 0, len(fs.files)-fs.mergeFanIn+1)
+		remaining = append(remaining, fs.files[fs.mergeFanIn:]...)
+		remaining = append(remaining, newName)
+		fs.files = remaining
+	}
+	return nil
+}
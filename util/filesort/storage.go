@@ -0,0 +1,181 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filesort
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// WriteCloser is an io.Writer that can be closed once a spill file has been
+// fully written.
+type WriteCloser interface {
+	io.Writer
+	io.Closer
+}
+
+// ReadSeekCloser is an io.Reader that can seek and be closed, the minimal
+// capability FileSorter needs to read back a spill file.
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Storage abstracts the filesystem access FileSorter needs for its spill
+// files, analogous to goleveldb's storage.Storage. This lets embedders swap
+// in e.g. an encrypted or tmpfs-only backend, and lets tests avoid touching
+// the real filesystem.
+type Storage interface {
+	// Create creates (or truncates) the named spill file for writing.
+	Create(name string) (WriteCloser, error)
+	// Open opens the named spill file for reading.
+	Open(name string) (ReadSeekCloser, error)
+	// Remove deletes the named spill file.
+	Remove(name string) error
+	// List returns the names of all spill files currently stored.
+	List() ([]string, error)
+}
+
+// FileStorage is a Storage backed by real files below a directory, which is
+// the behavior FileSorter used to have built in.
+type FileStorage struct {
+	dir string
+}
+
+// NewFileStorage creates a FileStorage rooted at dir. dir must already
+// exist; it is not created or removed by FileStorage itself.
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{dir: dir}
+}
+
+// Create implements the Storage Create interface.
+func (s *FileStorage) Create(name string) (WriteCloser, error) {
+	f, err := os.OpenFile(path.Join(s.dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return f, nil
+}
+
+// Open implements the Storage Open interface.
+func (s *FileStorage) Open(name string) (ReadSeekCloser, error) {
+	f, err := os.Open(path.Join(s.dir, name))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return f, nil
+}
+
+// Remove implements the Storage Remove interface.
+func (s *FileStorage) Remove(name string) error {
+	return errors.Trace(os.Remove(path.Join(s.dir, name)))
+}
+
+// List implements the Storage List interface.
+func (s *FileStorage) List() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// memReader adapts a *bytes.Reader to ReadSeekCloser.
+type memReader struct {
+	*bytes.Reader
+}
+
+// Close implements the io.Closer interface; it is a no-op since the
+// underlying data lives in memory.
+func (r *memReader) Close() error { return nil }
+
+// memWriter adapts a *bytes.Buffer to WriteCloser, publishing its contents
+// to the owning MemStorage on Close.
+type memWriter struct {
+	s    *MemStorage
+	name string
+	buf  bytes.Buffer
+}
+
+// Write implements the io.Writer interface.
+func (w *memWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+// Close implements the io.Closer interface, publishing the written bytes.
+func (w *memWriter) Close() error {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.s.files[w.name] = w.buf.Bytes()
+	return nil
+}
+
+// MemStorage is a Storage backed by in-memory buffers. It is useful for
+// tests and for sorts whose spill area overflows the heap but still fits
+// comfortably in RAM.
+type MemStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemStorage creates an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{files: make(map[string][]byte)}
+}
+
+// Create implements the Storage Create interface.
+func (s *MemStorage) Create(name string) (WriteCloser, error) {
+	return &memWriter{s: s, name: name}, nil
+}
+
+// Open implements the Storage Open interface.
+func (s *MemStorage) Open(name string) (ReadSeekCloser, error) {
+	s.mu.Lock()
+	data, ok := s.files[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errors.NotFoundf("spill file %q", name)
+	}
+	return &memReader{Reader: bytes.NewReader(data)}, nil
+}
+
+// Remove implements the Storage Remove interface.
+func (s *MemStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+// List implements the Storage List interface.
+func (s *MemStorage) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	return names, nil
+}